@@ -20,20 +20,34 @@ func (*T) Name(argType T1, replyType *T2) error
 
 func name(argType T1, replyType *T2) error
 
+Handlers may also take a context.Context as their first argument to observe
+cancellation when the calling Caller's CallContext deadline expires or is
+canceled:
+
+func (*T) Name(ctx context.Context, argType T1, replyType *T2) error
+
+Handlers that need to push more than one reply, e.g. progress updates,
+can instead take a send-only channel in place of the pointer reply:
+
+func (*T) Name(ctx context.Context, argType T1, out chan<- T2) error
+
+Callers invoke these with CallStream instead of Call/CallContext. Fire-and-
+forget messages that expect no reply at all are sent with Notify.
+
 Exported functions & methods should be made thread safe.
 
 */
 package blab
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
 	"net"
 	"os"
 	"strconv"
@@ -45,9 +59,6 @@ import (
 var ErrFail = errors.New("Request failed, service unavailable.")
 var ErrClosed = errors.New("Connection closed.")
 
-// Enable Communication Debugging.
-var Debug = false
-
 // Limit maximum number of concurrent connections/processes.
 var ConnectionLimit = 256
 
@@ -59,6 +70,9 @@ type msg struct {
 	Err string
 	Va1 []byte
 	Va2 []byte
+	// More marks this as one of several response frames sharing Tag, for
+	// streamed Call results; the final frame in a stream sends More = false.
+	More bool
 }
 
 // The Caller object is for both producers(registering methods/functions) and consumers(calls registered methods/functions).
@@ -75,24 +89,32 @@ type session struct {
 	// uplink is used to designate our dispatcher.
 	uplink *connection
 	// log is used for logging errors generated from background routines.
-	log *log.Logger
+	log Logger
 	// reqMap is for outbound request handling.
 	reqMap     map[int32]*bucket
 	reqMapLock sync.RWMutex
 	// localMap is for local methods/function lookup and execution.
-	localMap     map[string]func(*msg) *msg
+	localMap     map[string]func(c *connection, m *msg) *msg
 	localMapLock sync.RWMutex
 	// busyMap is so a Caller can request the status of a function already being fulfilled.
-	busyMap     map[string]map[int32]struct{}
+	// It also holds the cancel func for each in-flight handler's context, keyed by
+	// source address and tag, so session.close and incoming flushes can abort them.
+	busyMap     map[string]map[int32]context.CancelFunc
 	busyMapLock sync.RWMutex
 	// connMap keeps track of all routes that we can send from, if not matched here, send to uplink if avaialble, send Err if not.
 	connMap     map[string]*connection
 	connMapLock sync.RWMutex
+	// routeMap maps a registered method name to the connection that announced serving it, for broker relaying.
+	routeMap     map[string]*connection
+	routeMapLock sync.RWMutex
 	// peerLock is used to prevent multiple peer connections going to the same location.
 	peerLock int32
 	// ServeNode
 	serveNode *Caller
-	ready     uint32
+	// codecs lists the codecs this session offers during negotiation, most preferred first.
+	codecs []Codec
+	// tagSeq allocates unique tags for outbound Call requests.
+	tagSeq int32
 }
 
 // IPC Connection.
@@ -103,13 +125,41 @@ type connection struct {
 	id       string
 	routes   []string
 	sendLock sync.Mutex
+	// codecLock guards codec. It's separate from sendLock rather than reusing
+	// it: send can block inside sendLock for as long as the peer takes to
+	// read (net.Pipe has no buffering), and applyNegotiation runs on the
+	// receive loop, which must stay free to keep draining the peer's writes
+	// or the two connections deadlock on each other's pending send.
+	codecLock sync.Mutex
+	// codec is the wire codec this connection settled on during negotiation.
+	codec Codec
+	// reader buffers inbound bytes for codec.ReadMessage.
+	reader *bufio.Reader
+	// closeOnce ensures close's cleanup runs exactly once.
+	closeOnce sync.Once
+	// version is the protocol version this connection agreed on during its
+	// Tversion/Rversion handshake.
+	version string
+	// msize is the maximum message size this connection agreed on during
+	// its handshake; 0 until negotiated. Each connection negotiates its own,
+	// since a broker's session fans out to many concurrent connections.
+	msize uint32
+	// ready is closed once this connection's handshake and preamble (codec
+	// offer, regSelf, regAddr) have been sent, so outbound Calls placed
+	// right after Dial returns don't race raw request bytes onto the wire
+	// ahead of (or interleaved with) that setup traffic.
+	ready chan struct{}
+	// closed is closed by close(), so a goroutine blocked delivering to a
+	// bucket's reply channel (applying backpressure) can give up instead of
+	// leaking forever once the connection it's waiting on is gone.
+	closed chan struct{}
 }
 
 // Decodes msg.
 func decMessage(in []byte) (out *msg, err error) {
 
 	msgPart := strings.Split(string(in), "\x1f")
-	if len(msgPart) < 6 {
+	if len(msgPart) < 7 {
 		return nil, fmt.Errorf("Incomplete or corrupted message: %s", string(in))
 	}
 
@@ -137,6 +187,8 @@ func decMessage(in []byte) (out *msg, err error) {
 	}
 	out.Va2 = va2
 
+	out.More = msgPart[6] == "1"
+
 	return
 }
 
@@ -157,11 +209,13 @@ func NewCaller() *Caller {
 func newSession() *session {
 	return &session{
 		uplink:   nil,
-		log:      log.New(os.Stdout, "", log.LstdFlags),
+		log:      newStdLogger(os.Stdout),
 		reqMap:   make(map[int32]*bucket),
-		localMap: make(map[string]func(*msg) *msg),
-		busyMap:  make(map[string]map[int32]struct{}),
+		localMap: make(map[string]func(c *connection, m *msg) *msg),
+		busyMap:  make(map[string]map[int32]context.CancelFunc),
 		connMap:  make(map[string]*connection),
+		routeMap: make(map[string]*connection),
+		codecs:   defaultCodecs(),
 	}
 }
 
@@ -170,55 +224,44 @@ func (cl *Caller) SetOutput(w io.Writer) {
 	if cl.log == nil {
 		*cl = *NewCaller()
 	}
-	cl.log = log.New(w, "", 0)
+	cl.log = newStdLogger(w)
 	if cl.serveNode != nil {
 		cl.serveNode.log = cl.log
 	}
 	return
 }
 
-// Listens to socket files(socketf) for Callers.
-// If socketf is not open, Listen opens the file and connects itself to it. (producers)
-func (cl *Caller) Listen(socketf string) (err error) {
+// Listens on addr for Callers. addr may be a bare Unix socket path or a
+// URL-style address understood by a registered Transport (unix:///tmp/x.sock,
+// tcp://host:port, tcp+tls://host:port, mem://name).
+// If addr is not open, Listen opens a listener on it and serves this
+// Caller's registered methods there; it does not dial that listener itself. (producers)
+func (cl *Caller) Listen(addr string) (err error) {
 	cl.fork = false
 
-	// Attempt to open socket file, if this works, stop here and serve.
-	err = cl.open(socketf)
+	// Attempt to open addr, if this works, stop here and serve.
+	err = cl.open(addr)
 	if err == nil || !strings.Contains(err.Error(), "connection refused") && !strings.Contains(err.Error(), "no such file or directory") {
 		return err
 	}
 
-	// If not, we need to continue onward and setup a new socket file.
+	// If not, we need to continue onward and set up a new listener.
 	if cl.session == nil {
 		*cl = *NewCaller()
 	}
 
 	server := NewCaller()
 
-	server.socketf = socketf
+	server.socketf = addr
 	server.log = cl.log
-	cl.socketf = socketf
-
-	// Clean out old socket files.
-	s_split := strings.Split(socketf, "/")
-	if len(s_split) == 0 {
-		return fmt.Errorf("%s: incomplete path to socket file.", socketf)
-	}
-	sfile_name := s_split[len(s_split)-1]
-	path := strings.Join(s_split[0:len(s_split)-1], "/")
+	cl.socketf = addr
 
-	files, err := ioutil.ReadDir(path)
+	tr, listenAddr, err := resolveTransport(addr)
 	if err != nil {
-		return
-	}
-	for _, file := range files {
-		fname := file.Name()
-		if strings.Contains(fname, sfile_name) {
-			os.Remove(path + "/" + fname)
-		}
+		return err
 	}
 
-	l, err := net.Listen("unix", socketf)
+	l, err := tr.Listen(listenAddr)
 	if err != nil {
 		return err
 	}
@@ -245,9 +288,7 @@ func (cl *Caller) Listen(socketf string) (err error) {
 		go func() {
 			err = c.reciever()
 			if err != ErrClosed {
-				if Debug {
-					cl.log.Println(err)
-				}
+				cl.log.Error("connection closed", "conn_id", c.id, "err", err)
 				return
 			}
 			cl.limiter <- struct{}{}
@@ -255,25 +296,30 @@ func (cl *Caller) Listen(socketf string) (err error) {
 	}
 }
 
-// Creates socket file(socketf) connection to Broker, forks goroutine and returns. (consumers)
-func (cl *Caller) Dial(socketf string) error {
+// Creates a connection to addr's Broker, forks goroutine and returns. (consumers)
+func (cl *Caller) Dial(addr string) error {
 	cl.fork = true
-	return cl.open(socketf)
+	return cl.open(addr)
 }
 
-// Creates socket connection to file(socketf) launches listener, forks goroutine or blocks depending on method wrapper called.
-func (cl *Caller) open(socketf string) error {
+// Creates a connection to addr, launches listener, forks goroutine or blocks depending on method wrapper called.
+func (cl *Caller) open(addr string) error {
 	if cl.session == nil {
 		*cl = *NewCaller()
 	}
 
-	conn, err := net.Dial("unix", socketf)
+	tr, dialAddr, err := resolveTransport(addr)
+	if err != nil {
+		return err
+	}
+
+	conn, err := tr.Dial(dialAddr)
 	if err != nil {
 		return err
 	}
 	c := cl.addconnection(conn)
 
-	cl.socketf = socketf
+	cl.socketf = addr
 	cl.uplink = c
 
 	var done uint32
@@ -285,61 +331,88 @@ func (cl *Caller) open(socketf string) error {
 	} else {
 		go func() {
 			if err := c.reciever(); err != nil && err != ErrClosed {
-				cl.log.Println(err)
+				cl.log.Error("connection closed", "conn_id", c.id, "err", err)
 			}
 		}()
 		return nil
 	}
 }
 
-// Finds split in message when two messages are concatinated together.
-func findSplit(in []byte) (n int) {
-	for _, ch := range in {
-		if ch == '\x04' {
-			return n
-		}
-		n++
+// negotiate offers this connection's codec names to the peer; the codec
+// used to decode until the peer's own offer arrives is set synchronously
+// by reciever before negotiate ever runs, since the read loop starts
+// concurrently with negotiate's send.
+func (c *connection) negotiate() {
+	names := make([]string, len(c.sess.codecs))
+	for i, cd := range c.sess.codecs {
+		names[i] = cd.Name()
 	}
-	return n
+	data, _ := json.Marshal(names)
+	c.send(&msg{Tag: negotiateCodecTag, Va1: data})
+}
+
+// applyNegotiation settles this connection's codec once the peer's offer
+// has arrived, picking the first mutually supported codec. It takes
+// codecLock, the same lock send holds while reading c.codec, since this
+// runs on the receive loop concurrently with outbound sends during the
+// preamble.
+func (c *connection) applyNegotiation(offered []string) {
+	c.codecLock.Lock()
+	c.codec = negotiateCodec(offered, c.sess.codecs)
+	c.codecLock.Unlock()
 }
 
 // Listens to *connection, decodes msg's and passes them to switchboard.
 func (c *connection) reciever() (err error) {
-	inbuf := make([]byte, 1024)
-	input := inbuf[0:]
-
-	var sz int
-	var pbuf []byte
-
-	// Register all local functions with uplink or peer.
-
-	data, _ := json.Marshal(myAddr)
-	c.send(&msg{
-		Tag: regSelf,
-		Va1: data,
-	})
-
-	if c.sess.uplink != nil {
-		c.sess.localMapLock.RLock()
-		for name, _ := range c.sess.localMap {
-			data, _ := json.Marshal(name)
-			c.send(&msg{
-				Src: myAddr,
-				Tag: regAddr,
-				Va1: data,
-			})
-		}
-		c.sess.localMapLock.RUnlock()
+	// Tversion/Rversion handshake: agree on a protocol version and msize
+	// before anything else touches the wire.
+	if err = c.handshake(); err != nil {
+		c.close()
+		return
 	}
-	atomic.StoreUint32(&c.sess.ready, 1)
-	// Reciever loop for incoming messages.
-	for {
-		for n, _ := range input {
-			input[n] = 0
-		}
-		input = inbuf[0:]
 
-		sz, err = c.conn.Read(input)
+	c.reader = bufio.NewReader(c.conn)
+
+	// c.codec decodes with legacyCodec until the peer's own offer arrives
+	// and applyNegotiation settles on a mutually supported one; this must
+	// be set before the read loop below can possibly see its first frame.
+	c.codec = legacyCodec{}
+
+	// The preamble (codec offer, regSelf, regAddr) is pure outbound traffic,
+	// so it's sent from a goroutine rather than inline: on a transport with
+	// no buffering of its own (net.Pipe), both peers send their preambles
+	// before either starts reading, and a synchronous send here would
+	// deadlock waiting for a read the peer won't issue until its own
+	// preamble write returns.
+	go func() {
+		// Register all local functions with uplink or peer.
+		c.negotiate()
+
+		data, _ := json.Marshal(myAddr)
+		c.send(&msg{
+			Tag: regSelf,
+			Va1: data,
+		})
+
+		if c.sess.uplink != nil {
+			c.sess.localMapLock.RLock()
+			for name, _ := range c.sess.localMap {
+				data, _ := json.Marshal(name)
+				c.send(&msg{
+					Src: myAddr,
+					Tag: regAddr,
+					Va1: data,
+				})
+			}
+			c.sess.localMapLock.RUnlock()
+		}
+		close(c.ready)
+	}()
+	// Reciever loop for incoming messages: one length-prefixed frame per
+	// io.ReadFull, handed to the negotiated codec for decoding.
+	for {
+		var payload []byte
+		payload, err = readFrame(c.reader, c.msize)
 		if err != nil {
 			c.close()
 			if err == io.EOF {
@@ -348,39 +421,36 @@ func (c *connection) reciever() (err error) {
 			return
 		}
 
-		pbuf = append(pbuf, input[0:sz]...)
-
-		// \x1f used as a delimeter between messages.
-		for bytes.Contains(pbuf, []byte("\x04")) {
-			//sz := len(pbuf)
-
-			s := findSplit(pbuf)
-
-			var request *msg
+		var requests []*msg
+		requests, err = c.codec.ReadMessage(bufio.NewReader(bytes.NewReader(payload)))
+		if err != nil {
+			c.close()
+			return
+		}
 
-			request, err = decMessage(pbuf[0:s])
-			if err != nil {
-				c.close()
-				return
-			}
-			if Debug {
-				switch request.Tag {
-				case regAddr:
-					fmt.Printf("Recv: [%s] Registering Function: %s\n", c.id, request.Va1)
-				case regSelf:
-					fmt.Printf("Recv: Received registration from %s.\n", request.Va1[1:len(request.Va1)-1])
-				default:
-					fmt.Printf("Recv: [%s] Src: %s Dst: %s Tag: %d Err: %s \n", c.id, request.Src, request.Dst, request.Tag, request.Err)
-				}
+		// A codec normally decodes one frame to one message; jsonrpcCodec
+		// decodes a JSON-RPC batch to several, each handled independently.
+		for _, request := range requests {
+			switch request.Tag {
+			case negotiateCodecTag:
+				c.sess.log.Debug("offered codecs", "conn_id", c.id, "codecs", string(request.Va1))
+			case regAddr:
+				c.sess.log.Debug("registering function", "conn_id", c.id, "method", string(request.Va1))
+			case regSelf:
+				c.sess.log.Debug("received registration", "conn_id", c.id, "src", string(request.Va1[1:len(request.Va1)-1]))
+			default:
+				c.sess.log.Debug("recv", "conn_id", c.id, "src", request.Src, "dst", request.Dst, "tag", request.Tag, "err", request.Err)
 			}
-			c.sess.switchboard(c, request)
 
-			if len(pbuf)-s > 1 {
-				pbuf = pbuf[s+1:]
+			if request.Tag == negotiateCodecTag {
+				var offered []string
+				if err := json.Unmarshal(request.Va1, &offered); err == nil {
+					c.applyNegotiation(offered)
+				}
 				continue
 			}
-			pbuf = nil
+
+			c.sess.switchboard(c, request)
 		}
 	}
-	return
 }
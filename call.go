@@ -0,0 +1,184 @@
+package blab
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync/atomic"
+)
+
+// flushTag marks a control message that asks the receiving side to abort
+// the in-flight request named by Va1 (a JSON-encoded int32 tag), mirroring
+// 9P's Tflush. No reply is expected for the flush itself.
+const flushTag int32 = -1003
+
+// bucket tracks one outstanding Call, matched to its reply by tag.
+type bucket struct {
+	reply  chan *msg
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// nextTag allocates a tag for a new outbound request.
+func (s *session) nextTag() int32 {
+	for {
+		tag := atomic.AddInt32(&s.tagSeq, 1)
+		// Negative tags are reserved for control messages (negotiateCodecTag,
+		// flushTag, ...), so skip past zero if the counter wraps.
+		if tag > 0 {
+			return tag
+		}
+	}
+}
+
+// route picks the connection to send dst's request over: a direct route if
+// one is known, otherwise the uplink, matching connMap's documented intent.
+func (s *session) route(dst string) *connection {
+	s.connMapLock.RLock()
+	c, ok := s.connMap[dst]
+	s.connMapLock.RUnlock()
+	if ok {
+		return c
+	}
+	return s.uplink
+}
+
+// Call invokes method on dst with arg, blocking until reply is populated or
+// the call fails. It is equivalent to CallContext with context.Background().
+func (cl *Caller) Call(dst, method string, arg, reply interface{}) error {
+	return cl.CallContext(context.Background(), dst, method, arg, reply)
+}
+
+// CallContext invokes method on dst with arg, decoding the result into
+// reply. If ctx is canceled or its deadline expires before a reply
+// arrives, CallContext sends a flush for the request upstream and returns
+// ctx.Err() without waiting for the producer to acknowledge it.
+func (cl *Caller) CallContext(ctx context.Context, dst, method string, arg, reply interface{}) error {
+	c := cl.route(dst)
+	if c == nil {
+		return ErrFail
+	}
+
+	params, err := json.Marshal(arg)
+	if err != nil {
+		return err
+	}
+
+	tag := cl.nextTag()
+	bctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	b := &bucket{reply: make(chan *msg, 1), ctx: bctx, cancel: cancel}
+	cl.reqMapLock.Lock()
+	cl.reqMap[tag] = b
+	cl.reqMapLock.Unlock()
+	defer func() {
+		cl.reqMapLock.Lock()
+		delete(cl.reqMap, tag)
+		cl.reqMapLock.Unlock()
+	}()
+
+	// Wait for c's handshake/preamble to finish before putting a request on
+	// the wire: sending any earlier would race regSelf/regAddr and could
+	// land on the peer mid-handshake.
+	select {
+	case <-c.ready:
+	case <-bctx.Done():
+		return ctx.Err()
+	}
+
+	if err := c.send(&msg{Dst: method, Src: myAddr, Tag: tag, Va1: params}); err != nil {
+		return err
+	}
+
+	select {
+	case resp := <-b.reply:
+		if resp.Err != "" {
+			return errors.New(resp.Err)
+		}
+		return json.Unmarshal(resp.Va2, reply)
+	case <-bctx.Done():
+		oldtag, _ := json.Marshal(tag)
+		c.send(&msg{Src: myAddr, Tag: flushTag, Va1: oldtag})
+		return ctx.Err()
+	}
+}
+
+// trackBusy registers a cancelable context for a handler invocation keyed
+// by the requester's address and tag, so a later flush or session.close can
+// abort it via cancelBusy. The returned cancel both cancels the context and
+// removes its busyMap entry, and must be called when the handler returns.
+func (s *session) trackBusy(src string, tag int32) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s.busyMapLock.Lock()
+	if s.busyMap[src] == nil {
+		s.busyMap[src] = make(map[int32]context.CancelFunc)
+	}
+	s.busyMap[src][tag] = cancel
+	s.busyMapLock.Unlock()
+
+	return ctx, func() {
+		cancel()
+		s.busyMapLock.Lock()
+		if inflight, ok := s.busyMap[src]; ok {
+			delete(inflight, tag)
+		}
+		s.busyMapLock.Unlock()
+	}
+}
+
+// cancelBusy cancels the context tracking an in-flight handler invocation,
+// if one is registered under src/tag, and drops the bookkeeping for it.
+// switchboard calls this on receipt of a flushTag message; session.close
+// does not go through it, but cancels every entry directly.
+func (s *session) cancelBusy(src string, tag int32) {
+	s.busyMapLock.Lock()
+	defer s.busyMapLock.Unlock()
+
+	if inflight, ok := s.busyMap[src]; ok {
+		if cancel, ok := inflight[tag]; ok {
+			cancel()
+			delete(inflight, tag)
+		}
+	}
+}
+
+// close cancels every handler invocation still tracked in busyMap, then
+// closes every connection in connMap, so a caller shutting down a session
+// doesn't leave in-flight handlers or sockets running behind it.
+func (s *session) close() error {
+	s.busyMapLock.Lock()
+	for src, inflight := range s.busyMap {
+		for tag, cancel := range inflight {
+			cancel()
+			delete(inflight, tag)
+		}
+		delete(s.busyMap, src)
+	}
+	s.busyMapLock.Unlock()
+
+	s.connMapLock.RLock()
+	conns := make([]*connection, 0, len(s.connMap))
+	for _, c := range s.connMap {
+		conns = append(conns, c)
+	}
+	s.connMapLock.RUnlock()
+
+	for _, c := range conns {
+		c.close()
+	}
+
+	if s.uplink != nil {
+		s.uplink.close()
+	}
+
+	return nil
+}
+
+// Close shuts down cl's session: every handler invocation still tracked as
+// busy is canceled, and every connection (including the uplink set up by
+// Dial/Listen) is closed.
+func (cl *Caller) Close() error {
+	return cl.session.close()
+}
@@ -0,0 +1,82 @@
+package blab
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// wrapUnary-based handlers don't run over the wire in these tests; they're
+// invoked directly against a bare session, with busyMap canceled the same
+// way switchboard or session.close would, to isolate the reply-dropping
+// behavior from connection/codec plumbing.
+
+func TestCancelBusyDropsPendingReply(t *testing.T) {
+	s := newSession()
+
+	started := make(chan struct{})
+	proceed := make(chan struct{})
+	handler, err := wrapHandler(func(ctx context.Context, arg string, reply *string) error {
+		close(started)
+		<-proceed
+		*reply = arg
+		return ctx.Err()
+	})
+	if err != nil {
+		t.Fatalf("wrapHandler: %v", err)
+	}
+
+	c := &connection{sess: s}
+	const src, tag = "caller-addr", int32(7)
+	replyc := make(chan *msg, 1)
+	go func() { replyc <- handler(c, &msg{Src: src, Tag: tag, Va1: []byte(`"hi"`)}) }()
+
+	<-started
+	s.cancelBusy(src, tag)
+	close(proceed)
+
+	if reply := <-replyc; reply != nil {
+		t.Fatalf("got reply %+v, want nil (dropped after cancellation)", reply)
+	}
+}
+
+func TestSessionCloseCancelsBusyHandlers(t *testing.T) {
+	s := newSession()
+
+	started := make(chan struct{})
+	done := make(chan error, 1)
+	handler, err := wrapHandler(func(ctx context.Context, arg string, reply *string) error {
+		close(started)
+		<-ctx.Done()
+		done <- ctx.Err()
+		return ctx.Err()
+	})
+	if err != nil {
+		t.Fatalf("wrapHandler: %v", err)
+	}
+
+	c := &connection{sess: s}
+	go handler(c, &msg{Src: "caller-addr", Tag: 1, Va1: []byte(`"hi"`)})
+	<-started
+
+	if err := s.close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("got handler ctx err %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("close did not cancel the in-flight handler")
+	}
+
+	s.busyMapLock.RLock()
+	defer s.busyMapLock.RUnlock()
+	for src, inflight := range s.busyMap {
+		if len(inflight) != 0 {
+			t.Fatalf("busyMap[%q] still has %d entries after close", src, len(inflight))
+		}
+	}
+}
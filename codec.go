@@ -0,0 +1,273 @@
+package blab
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Codec frames and (de)serializes msg values for a connection. blab ships
+// two: the original \x1f/\x04-delimited framing (legacyCodec) and a
+// JSON-RPC 2.0 codec (jsonrpcCodec). Connections negotiate a codec on
+// connect so peers running different versions of blab can still interoperate.
+type Codec interface {
+	// Name identifies the codec during negotiation, e.g. "legacy" or "jsonrpc2".
+	Name() string
+	// WriteMessage frames m and writes it to w.
+	WriteMessage(w io.Writer, m *msg) error
+	// ReadMessage reads and decodes the next frame from r into one or more
+	// messages; a JSON-RPC batch decodes to one msg per batch entry.
+	ReadMessage(r *bufio.Reader) ([]*msg, error)
+}
+
+// negotiateCodecTag is a control tag carrying a connection's offered codec
+// names (most preferred first, JSON-encoded []string) as Va1. It is sent
+// first in the connection preamble, ahead of regSelf/regAddr; a peer that
+// never sends one is decoded with legacyCodec.
+const negotiateCodecTag int32 = -1001
+
+// defaultCodecs lists the codecs a Caller offers during negotiation, most
+// preferred first.
+func defaultCodecs() []Codec {
+	return []Codec{legacyCodec{}, jsonrpcCodec{}}
+}
+
+// negotiateCodec picks the first mutually supported codec from offered,
+// in the offerer's preference order. It falls back to legacyCodec so that
+// older peers which never negotiate still work.
+func negotiateCodec(offered []string, supported []Codec) Codec {
+	for _, name := range offered {
+		for _, c := range supported {
+			if c.Name() == name {
+				return c
+			}
+		}
+	}
+	return legacyCodec{}
+}
+
+// legacyCodec is the original \x1f-delimited, base64-in-JSON framing. It is
+// kept as the default so existing deployments keep working untouched.
+type legacyCodec struct{}
+
+func (legacyCodec) Name() string { return "legacy" }
+
+func (legacyCodec) WriteMessage(w io.Writer, m *msg) error {
+	more := "0"
+	if m.More {
+		more = "1"
+	}
+	parts := []string{
+		m.Dst,
+		m.Src,
+		m.Err,
+		strconv.FormatInt(int64(m.Tag), 10),
+		base64.StdEncoding.EncodeToString(m.Va1),
+		base64.StdEncoding.EncodeToString(m.Va2),
+		more,
+	}
+	_, err := w.Write([]byte(strings.Join(parts, "\x1f") + "\x04"))
+	return err
+}
+
+func (legacyCodec) ReadMessage(r *bufio.Reader) ([]*msg, error) {
+	raw, err := r.ReadBytes('\x04')
+	if err != nil {
+		return nil, err
+	}
+	m, err := decMessage(raw[:len(raw)-1])
+	if err != nil {
+		return nil, err
+	}
+	return []*msg{m}, nil
+}
+
+// jsonrpcRequest is a JSON-RPC 2.0 request or notification object.
+type jsonrpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+// jsonrpcError is a JSON-RPC 2.0 error object.
+type jsonrpcError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// jsonrpcResponse is a JSON-RPC 2.0 response object. Exactly one of Result
+// or Error is set, per spec. More is a blab extension carrying msg.More,
+// for responses that are one frame of a CallStream.
+type jsonrpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *jsonrpcError   `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	More    bool            `json:"more,omitempty"`
+}
+
+// jsonrpcCodec implements the JSON-RPC 2.0 spec: requests carry Dst/Method/
+// Va1 as method+params, responses carry Tag as the correlating id and
+// either Va2 (result) or Err (error message) as the outcome. Batches are
+// not emitted but are accepted on read, decoding to one msg per entry.
+// Frames are Content-Length delimited, which keeps payload bytes from ever
+// colliding with the delimiter the way the legacy codec's raw \x04
+// splitting could.
+type jsonrpcCodec struct{}
+
+func (jsonrpcCodec) Name() string { return "jsonrpc2" }
+
+func (jsonrpcCodec) WriteMessage(w io.Writer, m *msg) error {
+	var body []byte
+	var err error
+
+	if m.Err == "" && len(m.Va2) == 0 {
+		// Outbound call: Dst carries the method name, Va1 the params. A
+		// zero tag means no reply is expected, i.e. a notification, which
+		// per spec omits "id" entirely.
+		req := jsonrpcRequest{
+			JSONRPC: "2.0",
+			Method:  m.Dst,
+			Params:  json.RawMessage(m.Va1),
+		}
+		if m.Tag != 0 {
+			req.ID = json.RawMessage(strconv.FormatInt(int64(m.Tag), 10))
+		}
+		body, err = json.Marshal(req)
+	} else {
+		resp := jsonrpcResponse{
+			JSONRPC: "2.0",
+			ID:      json.RawMessage(strconv.FormatInt(int64(m.Tag), 10)),
+			More:    m.More,
+		}
+		if m.Err != "" {
+			resp.Error = &jsonrpcError{Code: -32000, Message: m.Err}
+		} else {
+			resp.Result = json.RawMessage(m.Va2)
+		}
+		body, err = json.Marshal(resp)
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := fmt.Fprintf(w, "Content-Length: %d\r\n\r\n", len(body)); err != nil {
+		return err
+	}
+	_, err = w.Write(body)
+	return err
+}
+
+func (jsonrpcCodec) ReadMessage(r *bufio.Reader) ([]*msg, error) {
+	length := -1
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(strings.ToLower(line), "content-length:") {
+			n, err := strconv.Atoi(strings.TrimSpace(line[len("content-length:"):]))
+			if err != nil {
+				return nil, fmt.Errorf("jsonrpc2: bad Content-Length: %s", line)
+			}
+			length = n
+		}
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("jsonrpc2: missing Content-Length header")
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(trimmed, &batch); err != nil || len(batch) == 0 {
+			return nil, fmt.Errorf("jsonrpc2: empty or malformed batch")
+		}
+		msgs := make([]*msg, 0, len(batch))
+		for _, entry := range batch {
+			m, err := jsonrpcToMsg(entry)
+			if err != nil {
+				return nil, err
+			}
+			msgs = append(msgs, m)
+		}
+		return msgs, nil
+	}
+
+	m, err := jsonrpcToMsg(trimmed)
+	if err != nil {
+		return nil, err
+	}
+	return []*msg{m}, nil
+}
+
+// parseJSONRPCID parses a JSON-RPC id into blab's int32 tag space. An
+// absent id (a notification) maps to tag 0; a present id that isn't a
+// JSON number is rejected outright rather than silently collapsed to 0,
+// which would otherwise misroute a spec-legal string id as a Notify that
+// expects no reply.
+func parseJSONRPCID(id json.RawMessage) (int32, error) {
+	if len(id) == 0 {
+		return 0, nil
+	}
+	tag, err := strconv.ParseInt(string(id), 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("jsonrpc2: id %s is not a supported tag (blab requires numeric ids)", id)
+	}
+	return int32(tag), nil
+}
+
+func jsonrpcToMsg(body []byte) (*msg, error) {
+	var probe struct {
+		Method string `json:"method"`
+	}
+	json.Unmarshal(body, &probe)
+
+	if probe.Method != "" {
+		var req jsonrpcRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			return nil, fmt.Errorf("jsonrpc2: %v", err)
+		}
+		tag, err := parseJSONRPCID(req.ID)
+		if err != nil {
+			return nil, err
+		}
+		return &msg{
+			Dst: req.Method,
+			Tag: tag,
+			Va1: []byte(req.Params),
+		}, nil
+	}
+
+	var resp jsonrpcResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("jsonrpc2: %v", err)
+	}
+	tag, err := parseJSONRPCID(resp.ID)
+	if err != nil {
+		return nil, err
+	}
+	out := &msg{Tag: tag, More: resp.More}
+	if resp.Error != nil {
+		out.Err = resp.Error.Message
+	} else {
+		out.Va2 = []byte(resp.Result)
+	}
+	return out, nil
+}
@@ -0,0 +1,94 @@
+package blab
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	"testing"
+)
+
+func frameBody(body []byte) []byte {
+	framed := []byte("Content-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n")
+	return append(framed, body...)
+}
+
+func roundTrip(t *testing.T, c Codec, m *msg) []*msg {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := c.WriteMessage(&buf, m); err != nil {
+		t.Fatalf("WriteMessage: %v", err)
+	}
+	out, err := c.ReadMessage(bufio.NewReader(&buf))
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	return out
+}
+
+func TestLegacyCodecRoundTrip(t *testing.T) {
+	in := &msg{Dst: "Echo", Src: "blab-1", Tag: 7, Va1: []byte(`"hi"`), More: true}
+	out := roundTrip(t, legacyCodec{}, in)
+	if len(out) != 1 {
+		t.Fatalf("got %d messages, want 1", len(out))
+	}
+	got := out[0]
+	if got.Dst != in.Dst || got.Src != in.Src || got.Tag != in.Tag || got.More != in.More {
+		t.Fatalf("round trip mismatch: got %+v, want %+v", got, in)
+	}
+	if string(got.Va1) != string(in.Va1) {
+		t.Fatalf("Va1 mismatch: got %q, want %q", got.Va1, in.Va1)
+	}
+}
+
+func TestJSONRPCCodecRoundTrip(t *testing.T) {
+	in := &msg{Dst: "Echo", Tag: 3, Va1: []byte(`{"n":1}`)}
+	out := roundTrip(t, jsonrpcCodec{}, in)
+	if len(out) != 1 {
+		t.Fatalf("got %d messages, want 1", len(out))
+	}
+	if out[0].Dst != in.Dst || out[0].Tag != in.Tag {
+		t.Fatalf("round trip mismatch: got %+v, want %+v", out[0], in)
+	}
+}
+
+func TestJSONRPCCodecNotificationHasNoID(t *testing.T) {
+	var buf bytes.Buffer
+	if err := (jsonrpcCodec{}).WriteMessage(&buf, &msg{Dst: "Ping", Tag: 0}); err != nil {
+		t.Fatalf("WriteMessage: %v", err)
+	}
+	if bytes.Contains(buf.Bytes(), []byte(`"id"`)) {
+		t.Fatalf("notification should omit \"id\", got %s", buf.Bytes())
+	}
+
+	out := roundTrip(t, jsonrpcCodec{}, &msg{Dst: "Ping", Tag: 0})
+	if len(out) != 1 || out[0].Tag != 0 {
+		t.Fatalf("notification should decode to tag 0, got %+v", out)
+	}
+}
+
+func TestJSONRPCCodecDecodesEveryBatchEntry(t *testing.T) {
+	body := []byte(`[{"jsonrpc":"2.0","method":"A","id":1},{"jsonrpc":"2.0","method":"B","id":2},{"jsonrpc":"2.0","method":"C","id":3}]`)
+	framed := frameBody(body)
+
+	var codec jsonrpcCodec
+	out, err := codec.ReadMessage(bufio.NewReader(bytes.NewReader(framed)))
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	if len(out) != 3 {
+		t.Fatalf("got %d messages, want 3 (one per batch entry)", len(out))
+	}
+	for i, want := range []string{"A", "B", "C"} {
+		if out[i].Dst != want {
+			t.Errorf("entry %d: got Dst %q, want %q", i, out[i].Dst, want)
+		}
+	}
+}
+
+func TestJSONRPCCodecRejectsNonNumericID(t *testing.T) {
+	framed := frameBody([]byte(`{"jsonrpc":"2.0","method":"A","id":"abc"}`))
+	var codec jsonrpcCodec
+	if _, err := codec.ReadMessage(bufio.NewReader(bytes.NewReader(framed))); err == nil {
+		t.Fatal("expected an error for a non-numeric id, got nil")
+	}
+}
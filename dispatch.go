@@ -0,0 +1,175 @@
+package blab
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync/atomic"
+)
+
+// myAddr is this process's address, announced to peers via regSelf during
+// the connection preamble so they can route Calls back to us.
+var myAddr = generateAddr()
+
+func generateAddr() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("blab-%d", atomic.AddInt32(&connSeq, 1))
+	}
+	return "blab-" + hex.EncodeToString(b[:])
+}
+
+// regSelf and regAddr are control tags exchanged right after a connection
+// is established: regSelf announces the sender's address, regAddr
+// announces that the sender's address serves the method named in Va1.
+// Both are handled by switchboard and never reach a registered handler.
+const (
+	regSelf int32 = -1
+	regAddr int32 = -2
+)
+
+// connSeq allocates the ids addconnection assigns connections that haven't
+// announced an address yet (used in logging before regSelf arrives).
+var connSeq int32
+
+// addconnection wraps conn in a *connection tied to this Caller's session.
+func (cl *Caller) addconnection(conn net.Conn) *connection {
+	return &connection{
+		conn:   conn,
+		sess:   cl.session,
+		id:     fmt.Sprintf("conn-%d", atomic.AddInt32(&connSeq, 1)),
+		ready:  make(chan struct{}),
+		closed: make(chan struct{}),
+	}
+}
+
+// send encodes m with the connection's negotiated codec (legacyCodec until
+// negotiation completes) and writes it as one length-prefixed frame.
+func (c *connection) send(m *msg) error {
+	c.codecLock.Lock()
+	codec := c.codec
+	c.codecLock.Unlock()
+	if codec == nil {
+		codec = legacyCodec{}
+	}
+
+	c.sendLock.Lock()
+	defer c.sendLock.Unlock()
+
+	var buf bytes.Buffer
+	if err := codec.WriteMessage(&buf, m); err != nil {
+		return err
+	}
+
+	if c.msize != 0 && uint32(buf.Len()) > c.msize {
+		return ErrMessageTooLarge
+	}
+
+	return writeFrame(c.conn, buf.Bytes())
+}
+
+// close tears down the connection and removes it from sess.connMap, if it
+// was ever registered there. It is safe to call more than once.
+func (c *connection) close() error {
+	c.closeOnce.Do(func() {
+		c.conn.Close()
+		close(c.closed)
+		if c.id != "" {
+			c.sess.connMapLock.Lock()
+			if c.sess.connMap[c.id] == c {
+				delete(c.sess.connMap, c.id)
+			}
+			c.sess.connMapLock.Unlock()
+		}
+	})
+	return nil
+}
+
+// switchboard routes one decoded message: registration control messages
+// update connMap/routeMap, flush messages cancel busy handler contexts,
+// messages matching an outstanding Call are delivered to its bucket, and
+// everything else is dispatched to a locally registered method or relayed
+// to whichever connection announced serving it (falling back to uplink).
+func (s *session) switchboard(c *connection, m *msg) {
+	switch m.Tag {
+	case regSelf:
+		var addr string
+		if err := json.Unmarshal(m.Va1, &addr); err != nil {
+			return
+		}
+		c.id = addr
+		s.connMapLock.Lock()
+		s.connMap[addr] = c
+		s.connMapLock.Unlock()
+		return
+	case regAddr:
+		var method string
+		if err := json.Unmarshal(m.Va1, &method); err != nil {
+			return
+		}
+		s.routeMapLock.Lock()
+		s.routeMap[method] = c
+		s.routeMapLock.Unlock()
+		return
+	case flushTag:
+		var oldtag int32
+		if err := json.Unmarshal(m.Va1, &oldtag); err != nil {
+			return
+		}
+		s.cancelBusy(m.Src, oldtag)
+		return
+	}
+
+	// A reply to one of our own outstanding Calls is matched by tag. The
+	// send blocks to apply real backpressure instead of silently dropping
+	// a frame (which, for a CallStream, could drop the terminating frame
+	// and wedge the consumer forever); it gives up if the connection it
+	// arrived on closes, or if the caller has already stopped waiting.
+	s.reqMapLock.RLock()
+	b, waiting := s.reqMap[m.Tag]
+	s.reqMapLock.RUnlock()
+	if waiting {
+		select {
+		case b.reply <- m:
+		case <-c.closed:
+		case <-b.ctx.Done():
+		}
+		return
+	}
+
+	// Otherwise this is an inbound request: dispatch it to a locally
+	// registered handler, or relay it to whichever connection registered
+	// the method, or finally to our own uplink.
+	s.localMapLock.RLock()
+	handler, ok := s.localMap[m.Dst]
+	s.localMapLock.RUnlock()
+	if ok {
+		go func() {
+			reply := handler(c, m)
+			if reply != nil && m.Tag != 0 {
+				c.send(reply)
+			}
+		}()
+		return
+	}
+
+	s.routeMapLock.RLock()
+	route, ok := s.routeMap[m.Dst]
+	s.routeMapLock.RUnlock()
+	if ok && route != c {
+		route.send(m)
+		return
+	}
+
+	if s.uplink != nil && s.uplink != c {
+		s.uplink.send(m)
+		return
+	}
+
+	if m.Tag != 0 {
+		c.send(&msg{Tag: m.Tag, Err: ErrFail.Error()})
+	}
+}
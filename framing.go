@@ -0,0 +1,121 @@
+package blab
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ErrMessageTooLarge is returned when a frame's size exceeds the
+// connection's negotiated msize, on send or on receive.
+var ErrMessageTooLarge = errors.New("blab: message exceeds negotiated msize")
+
+// ProtocolVersion is this build's wire protocol version, "<major>.<minor>".
+// Peers are refused when their major version doesn't match ours; the minor
+// version is informational only.
+const ProtocolVersion = "2.0"
+
+// DefaultMsize is the maximum message size a Caller proposes during the
+// version handshake when none has been configured.
+const DefaultMsize uint32 = 1 << 20 // 1 MiB
+
+// versionMsg is the Tversion/Rversion handshake payload: each side proposes
+// a version and msize, modeled directly on 9P's version negotiation.
+type versionMsg struct {
+	Version string
+	Msize   uint32
+}
+
+// handshake performs the version/msize exchange described in versionMsg.
+// It runs directly over the raw connection, before any codec has been
+// negotiated, using the same length-prefixed framing as the rest of the
+// protocol. The lower of the two proposed msizes wins; a major version
+// mismatch refuses the connection outright.
+//
+// The write and read run concurrently rather than write-then-read: both
+// sides of a connection call handshake() at the same time, and a
+// synchronous send would deadlock on a transport with no buffering of its
+// own (net.Pipe, used by the mem transport) since each side's write would
+// block on a read the peer hasn't issued yet.
+func (c *connection) handshake() error {
+	proposed := c.msize
+	if proposed == 0 {
+		proposed = DefaultMsize
+	}
+
+	out, err := json.Marshal(versionMsg{Version: ProtocolVersion, Msize: proposed})
+	if err != nil {
+		return err
+	}
+
+	writeErr := make(chan error, 1)
+	go func() { writeErr <- writeFrame(c.conn, out) }()
+
+	in, err := readFrame(c.conn, DefaultMsize)
+	if err != nil {
+		<-writeErr
+		return err
+	}
+	if err := <-writeErr; err != nil {
+		return err
+	}
+
+	var peer versionMsg
+	if err := json.Unmarshal(in, &peer); err != nil {
+		return fmt.Errorf("blab: malformed version handshake: %v", err)
+	}
+
+	if majorVersion(peer.Version) != majorVersion(ProtocolVersion) {
+		return fmt.Errorf("blab: incompatible protocol version %q (have %q)", peer.Version, ProtocolVersion)
+	}
+
+	agreed := proposed
+	if peer.Msize < agreed {
+		agreed = peer.Msize
+	}
+	c.version = ProtocolVersion
+	c.msize = agreed
+	return nil
+}
+
+func majorVersion(version string) string {
+	if i := strings.IndexByte(version, '.'); i >= 0 {
+		return version[:i]
+	}
+	return version
+}
+
+// writeFrame writes payload prefixed with its length as a 4-byte
+// little-endian header, so framing never depends on scanning payload
+// bytes for a delimiter.
+func writeFrame(w io.Writer, payload []byte) error {
+	var hdr [4]byte
+	binary.LittleEndian.PutUint32(hdr[:], uint32(len(payload)))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// readFrame reads a 4-byte little-endian length header followed by exactly
+// that many bytes in a single io.ReadFull, refusing frames that declare a
+// size larger than msize.
+func readFrame(r io.Reader, msize uint32) ([]byte, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	n := binary.LittleEndian.Uint32(hdr[:])
+	if n > msize {
+		return nil, ErrMessageTooLarge
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
@@ -0,0 +1,115 @@
+package blab
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWriteReadFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	want := []byte("hello, frame")
+	if err := writeFrame(&buf, want); err != nil {
+		t.Fatalf("writeFrame: %v", err)
+	}
+	got, err := readFrame(&buf, DefaultMsize)
+	if err != nil {
+		t.Fatalf("readFrame: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestReadFrameRejectsOversizedPayload(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeFrame(&buf, []byte("0123456789")); err != nil {
+		t.Fatalf("writeFrame: %v", err)
+	}
+	if _, err := readFrame(&buf, 4); err != ErrMessageTooLarge {
+		t.Fatalf("got err %v, want ErrMessageTooLarge", err)
+	}
+}
+
+func TestHandshakeNegotiatesPerConnectionMsize(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	cSess, sSess := newSession(), newSession()
+	cConn := &connection{conn: client, sess: cSess, msize: 64}
+	sConn := &connection{conn: server, sess: sSess, msize: 128}
+
+	errc := make(chan error, 2)
+	go func() { errc <- cConn.handshake() }()
+	go func() { errc <- sConn.handshake() }()
+	for i := 0; i < 2; i++ {
+		if err := <-errc; err != nil {
+			t.Fatalf("handshake: %v", err)
+		}
+	}
+
+	if cConn.msize != 64 || sConn.msize != 64 {
+		t.Fatalf("expected both sides to settle on the lower msize 64, got client=%d server=%d", cConn.msize, sConn.msize)
+	}
+	if cConn.version != ProtocolVersion || sConn.version != ProtocolVersion {
+		t.Fatalf("expected both sides to record version %q, got client=%q server=%q", ProtocolVersion, cConn.version, sConn.version)
+	}
+}
+
+// TestMemTransportCallDoesNotDeadlock reproduces a real connection over the
+// mem transport end to end: Listen, Register, Dial, Call. mem is backed by
+// net.Pipe, which has no buffering of its own, so a write-then-read
+// handshake or preamble (rather than one run concurrently with the other
+// side's) deadlocks here even though it happens to work over a buffered
+// socket.
+func TestMemTransportCallDoesNotDeadlock(t *testing.T) {
+	addr := "mem://" + t.Name()
+
+	srv := NewCaller()
+	if err := srv.Register("Echo", func(arg string, reply *string) error {
+		*reply = arg
+		return nil
+	}); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+
+	listenErr := make(chan error, 1)
+	go func() { listenErr <- srv.Listen(addr) }()
+
+	// Listen runs its Accept loop in the background goroutine above, so
+	// retry the dial until the listener has actually registered.
+	var cl *Caller
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		cl = NewCaller()
+		if err := cl.Dial(addr); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Dial: listener never came up on %s", addr)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		var reply string
+		err := cl.Call(myAddr, "Echo", "hello", &reply)
+		if err == nil && reply != "hello" {
+			err = fmt.Errorf("got reply %q, want %q", reply, "hello")
+		}
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Call: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Call deadlocked")
+	}
+}
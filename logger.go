@@ -0,0 +1,83 @@
+package blab
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+)
+
+// Logger is the structured logging sink blab emits diagnostics through.
+// kv is a flat list of alternating key/value pairs, e.g.
+// log.Debug("recv", "conn_id", c.id, "tag", request.Tag). Implement this
+// to route blab's output into logrus, zap, or any other logger without
+// forking the package.
+type Logger interface {
+	Debug(msg string, kv ...interface{})
+	Info(msg string, kv ...interface{})
+	Warn(msg string, kv ...interface{})
+	Error(msg string, kv ...interface{})
+}
+
+// stdLogger is the default Logger, backed by the standard library's log
+// package. Debug events are only written when debug is enabled, which
+// replaces the old package-global Debug switch.
+type stdLogger struct {
+	mu    sync.Mutex
+	out   *log.Logger
+	debug bool
+}
+
+func newStdLogger(w io.Writer) *stdLogger {
+	return &stdLogger{out: log.New(w, "", log.LstdFlags)}
+}
+
+func (l *stdLogger) Debug(msg string, kv ...interface{}) {
+	if l.debugEnabled() {
+		l.write("DEBUG", msg, kv...)
+	}
+}
+
+func (l *stdLogger) Info(msg string, kv ...interface{})  { l.write("INFO", msg, kv...) }
+func (l *stdLogger) Warn(msg string, kv ...interface{})  { l.write("WARN", msg, kv...) }
+func (l *stdLogger) Error(msg string, kv ...interface{}) { l.write("ERROR", msg, kv...) }
+
+func (l *stdLogger) debugEnabled() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.debug
+}
+
+func (l *stdLogger) write(level, msg string, kv ...interface{}) {
+	var b strings.Builder
+	b.WriteString(level)
+	b.WriteString(": ")
+	b.WriteString(msg)
+	for i := 0; i+1 < len(kv); i += 2 {
+		fmt.Fprintf(&b, " %v=%v", kv[i], kv[i+1])
+	}
+	l.out.Println(b.String())
+}
+
+// SetLogger replaces the Logger blab's diagnostics are written through.
+func (cl *Caller) SetLogger(l Logger) {
+	if cl.session == nil {
+		*cl = *NewCaller()
+	}
+	cl.log = l
+	if cl.serveNode != nil {
+		cl.serveNode.log = l
+	}
+}
+
+// SetDebug toggles debug-level output on the default Logger. It is a no-op
+// if SetLogger installed a custom Logger, since debug gating is then that
+// Logger's responsibility.
+func (cl *Caller) SetDebug(enabled bool) {
+	if std, ok := cl.log.(*stdLogger); ok {
+		std.mu.Lock()
+		std.debug = enabled
+		std.mu.Unlock()
+	}
+}
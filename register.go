@@ -0,0 +1,163 @@
+package blab
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+var ctxType = reflect.TypeOf((*context.Context)(nil)).Elem()
+var errType = reflect.TypeOf((*error)(nil)).Elem()
+
+// Register exposes fn under name so remote Callers can invoke it with
+// Call/CallContext/CallStream. fn must match one of the shapes documented
+// in the package doc:
+//
+//	func(argType T1, replyType *T2) error
+//	func(ctx context.Context, argType T1, replyType *T2) error
+//	func(ctx context.Context, argType T1, out chan<- T2) error
+func (cl *Caller) Register(name string, fn interface{}) error {
+	handler, err := wrapHandler(fn)
+	if err != nil {
+		return err
+	}
+
+	cl.localMapLock.Lock()
+	cl.localMap[name] = handler
+	cl.localMapLock.Unlock()
+	return nil
+}
+
+// wrapHandler validates fn's shape via reflection and adapts it to the
+// func(*connection, *msg) *msg signature localMap dispatches through.
+func wrapHandler(fn interface{}) (func(c *connection, m *msg) *msg, error) {
+	v := reflect.ValueOf(fn)
+	t := v.Type()
+	if t.Kind() != reflect.Func {
+		return nil, fmt.Errorf("blab: Register: %T is not a function", fn)
+	}
+
+	hasCtx := t.NumIn() > 0 && t.In(0) == ctxType
+	argIdx := 0
+	if hasCtx {
+		argIdx = 1
+	}
+	if t.NumIn() != argIdx+2 {
+		return nil, fmt.Errorf("blab: Register: %T has the wrong number of arguments", fn)
+	}
+	if t.NumOut() != 1 || t.Out(0) != errType {
+		return nil, fmt.Errorf("blab: Register: %T must return error", fn)
+	}
+
+	argType := t.In(argIdx)
+	second := t.In(argIdx + 1)
+
+	switch second.Kind() {
+	case reflect.Ptr:
+		return wrapUnary(v, argType, hasCtx), nil
+	case reflect.Chan:
+		if second.ChanDir() != reflect.BothDir && second.ChanDir() != reflect.SendDir {
+			return nil, fmt.Errorf("blab: Register: %T's channel argument must accept sends", fn)
+		}
+		if !hasCtx {
+			return nil, fmt.Errorf("blab: Register: %T is a Stream handler and must take a context.Context", fn)
+		}
+		return wrapStream(v, argType, second.Elem()), nil
+	default:
+		return nil, fmt.Errorf("blab: Register: %T's second argument must be a pointer or a channel", fn)
+	}
+}
+
+// wrapUnary adapts func([ctx,] argType, *replyType) error to one request/
+// one reply dispatch.
+func wrapUnary(v reflect.Value, argType reflect.Type, hasCtx bool) func(c *connection, m *msg) *msg {
+	return func(c *connection, m *msg) *msg {
+		argp := reflect.New(argType)
+		if len(m.Va1) > 0 {
+			if err := json.Unmarshal(m.Va1, argp.Interface()); err != nil {
+				return &msg{Tag: m.Tag, Err: err.Error()}
+			}
+		}
+
+		replyType := v.Type().In(v.Type().NumIn() - 1).Elem()
+		replyp := reflect.New(replyType)
+
+		in := make([]reflect.Value, 0, 3)
+		var ctx context.Context
+		if hasCtx {
+			var cancel context.CancelFunc
+			ctx, cancel = c.sess.trackBusy(m.Src, m.Tag)
+			defer cancel()
+			in = append(in, reflect.ValueOf(ctx))
+		}
+		in = append(in, argp.Elem(), replyp)
+
+		out := v.Call(in)
+
+		// A flush (or session.close) may have canceled ctx while the handler
+		// was running; its reply is stale by now, so drop it instead of
+		// shipping it back to a requester that's already given up on this
+		// tag.
+		if ctx != nil && ctx.Err() != nil {
+			return nil
+		}
+
+		if errv, _ := out[0].Interface().(error); errv != nil {
+			return &msg{Tag: m.Tag, Err: errv.Error()}
+		}
+
+		va2, err := json.Marshal(replyp.Interface())
+		if err != nil {
+			return &msg{Tag: m.Tag, Err: err.Error()}
+		}
+		return &msg{Tag: m.Tag, Va2: va2}
+	}
+}
+
+// wrapStream adapts func(ctx, argType, chan<- replyType) error, pushing
+// every value the handler sends as its own More = true response frame and
+// a final frame (More = false, or Err on failure) once it returns.
+func wrapStream(v reflect.Value, argType, elemType reflect.Type) func(c *connection, m *msg) *msg {
+	return func(c *connection, m *msg) *msg {
+		argp := reflect.New(argType)
+		if len(m.Va1) > 0 {
+			if err := json.Unmarshal(m.Va1, argp.Interface()); err != nil {
+				c.send(&msg{Tag: m.Tag, Err: err.Error()})
+				return nil
+			}
+		}
+
+		ctx, cancel := c.sess.trackBusy(m.Src, m.Tag)
+		defer cancel()
+
+		ch := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, elemType), 0)
+		done := make(chan error, 1)
+		go func() {
+			out := v.Call([]reflect.Value{reflect.ValueOf(ctx), argp.Elem(), ch})
+			errv, _ := out[0].Interface().(error)
+			done <- errv
+			ch.Close()
+		}()
+
+		for {
+			item, ok := ch.Recv()
+			if !ok {
+				break
+			}
+			data, err := json.Marshal(item.Interface())
+			if err != nil {
+				c.send(&msg{Tag: m.Tag, Err: err.Error()})
+				return nil
+			}
+			c.send(&msg{Tag: m.Tag, Va2: data, More: true})
+		}
+
+		if err := <-done; err != nil {
+			c.send(&msg{Tag: m.Tag, Err: err.Error()})
+		} else {
+			c.send(&msg{Tag: m.Tag})
+		}
+		return nil
+	}
+}
@@ -0,0 +1,121 @@
+package blab
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+)
+
+// Reply is one frame of a streamed response delivered to a CallStream
+// consumer. Data carries the raw JSON-encoded result for every frame but
+// the last, which instead carries a non-nil Err if the stream failed (or
+// nil on a clean end of stream).
+type Reply struct {
+	Data json.RawMessage
+	Err  error
+}
+
+// streamBacklog sizes the buffer CallStream holds frames in, so a fast
+// producer doesn't stall waiting on a slow consumer of the stream.
+const streamBacklog = 32
+
+// CallStream invokes a Stream handler registered as method on dst:
+//
+//	func(ctx context.Context, argType T1, out chan<- T2) error
+//
+// and returns a channel of Reply frames as the handler pushes to out. All
+// frames share Call's request tag; each carries More = true except the
+// final one, which signals the handler returned (successfully or with an
+// error, carried as the last Reply's Err). Canceling ctx flushes the
+// request upstream exactly as CallContext does and ends the stream with
+// ctx.Err().
+func (cl *Caller) CallStream(ctx context.Context, dst, method string, arg interface{}) (<-chan Reply, error) {
+	c := cl.route(dst)
+	if c == nil {
+		return nil, ErrFail
+	}
+
+	params, err := json.Marshal(arg)
+	if err != nil {
+		return nil, err
+	}
+
+	tag := cl.nextTag()
+	bctx, cancel := context.WithCancel(ctx)
+
+	b := &bucket{reply: make(chan *msg, streamBacklog), ctx: bctx, cancel: cancel}
+	cl.reqMapLock.Lock()
+	cl.reqMap[tag] = b
+	cl.reqMapLock.Unlock()
+
+	forget := func() {
+		cancel()
+		cl.reqMapLock.Lock()
+		delete(cl.reqMap, tag)
+		cl.reqMapLock.Unlock()
+	}
+
+	// See CallContext: don't put a request on the wire until c's
+	// handshake/preamble has finished.
+	select {
+	case <-c.ready:
+	case <-bctx.Done():
+		forget()
+		return nil, ctx.Err()
+	}
+
+	if err := c.send(&msg{Dst: method, Src: myAddr, Tag: tag, Va1: params, More: true}); err != nil {
+		forget()
+		return nil, err
+	}
+
+	out := make(chan Reply, streamBacklog)
+	go func() {
+		defer close(out)
+		defer forget()
+
+		for {
+			select {
+			case resp := <-b.reply:
+				if resp.Err != "" {
+					out <- Reply{Err: errors.New(resp.Err)}
+					return
+				}
+				out <- Reply{Data: resp.Va2}
+				if !resp.More {
+					return
+				}
+			case <-bctx.Done():
+				oldtag, _ := json.Marshal(tag)
+				c.send(&msg{Src: myAddr, Tag: flushTag, Va1: oldtag})
+				out <- Reply{Err: ctx.Err()}
+				return
+			}
+		}
+	}()
+
+	return out, nil
+}
+
+// Notify sends a fire-and-forget message to method on dst: no tag is
+// allocated, no bucket is created, and no reply is ever expected. This
+// mirrors a JSON-RPC notification, and lets producers push log/event-style
+// updates without a matching Call.
+func (cl *Caller) Notify(dst, method string, arg interface{}) error {
+	c := cl.route(dst)
+	if c == nil {
+		return ErrFail
+	}
+
+	params, err := json.Marshal(arg)
+	if err != nil {
+		return err
+	}
+
+	// See CallContext: don't put a request on the wire until c's
+	// handshake/preamble has finished. Notify takes no context, so this
+	// just waits; the connection becomes ready almost immediately.
+	<-c.ready
+
+	return c.send(&msg{Dst: method, Src: myAddr, Va1: params})
+}
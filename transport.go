@@ -0,0 +1,201 @@
+package blab
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Transport abstracts how a Caller listens for and dials peer connections,
+// so blab can run over more than Unix sockets and so producers can form a
+// network of methods across hosts, not just one box.
+type Transport interface {
+	Listen(addr string) (net.Listener, error)
+	Dial(addr string) (net.Conn, error)
+}
+
+var (
+	transportsLock sync.RWMutex
+	transports     = map[string]Transport{
+		"unix":    unixTransport{},
+		"tcp":     tcpTransport{},
+		"tcp+tls": tcpTLSTransport{},
+		"mem":     newMemTransport(),
+	}
+)
+
+// RegisterTransport adds or replaces the Transport used for scheme, so
+// callers can plug in their own (a QUIC or websocket transport, say)
+// alongside the built-ins.
+func RegisterTransport(scheme string, t Transport) {
+	transportsLock.Lock()
+	defer transportsLock.Unlock()
+	transports[scheme] = t
+}
+
+// resolveTransport splits a URL-style address (unix:///tmp/x.sock,
+// tcp://host:port, mem://name) into its Transport and the address that
+// transport expects. A bare path with no "scheme://" prefix is treated as
+// a unix address, so callers passing a plain socket file path keep working.
+func resolveTransport(addr string) (Transport, string, error) {
+	scheme, rest, ok := splitScheme(addr)
+	if !ok {
+		scheme, rest = "unix", addr
+	}
+
+	transportsLock.RLock()
+	t, ok := transports[scheme]
+	transportsLock.RUnlock()
+	if !ok {
+		return nil, "", fmt.Errorf("blab: unknown transport %q", scheme)
+	}
+	return t, rest, nil
+}
+
+func splitScheme(addr string) (scheme, rest string, ok bool) {
+	i := strings.Index(addr, "://")
+	if i < 0 {
+		return "", addr, false
+	}
+	return addr[:i], addr[i+len("://"):], true
+}
+
+// unixTransport dials and listens on Unix domain sockets, cleaning up
+// stale socket files left behind by a previous, uncleanly-stopped listener.
+type unixTransport struct{}
+
+func (unixTransport) Dial(addr string) (net.Conn, error) {
+	return net.Dial("unix", addr)
+}
+
+func (unixTransport) Listen(addr string) (net.Listener, error) {
+	sSplit := strings.Split(addr, "/")
+	if len(sSplit) == 0 {
+		return nil, fmt.Errorf("%s: incomplete path to socket file.", addr)
+	}
+	sfileName := sSplit[len(sSplit)-1]
+	path := strings.Join(sSplit[0:len(sSplit)-1], "/")
+
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		fname := file.Name()
+		if strings.Contains(fname, sfileName) {
+			os.Remove(path + "/" + fname)
+		}
+	}
+
+	return net.Listen("unix", addr)
+}
+
+// tcpTransport dials and listens on plain TCP.
+type tcpTransport struct{}
+
+func (tcpTransport) Dial(addr string) (net.Conn, error) { return net.Dial("tcp", addr) }
+
+func (tcpTransport) Listen(addr string) (net.Listener, error) { return net.Listen("tcp", addr) }
+
+// tcpTLSTransport dials and listens on TCP wrapped in TLS. The zero value
+// dials/listens with a nil *tls.Config; use NewTCPTLSTransport and
+// RegisterTransport to supply certificates or custom verification.
+type tcpTLSTransport struct {
+	config *tls.Config
+}
+
+// NewTCPTLSTransport builds a "tcp+tls" Transport using config. Register it
+// with RegisterTransport("tcp+tls", ...) to override the zero-config
+// default, or under a distinct scheme to use it alongside that default.
+func NewTCPTLSTransport(config *tls.Config) Transport {
+	return tcpTLSTransport{config: config}
+}
+
+func (t tcpTLSTransport) Dial(addr string) (net.Conn, error) {
+	return tls.Dial("tcp", addr, t.config)
+}
+
+func (t tcpTLSTransport) Listen(addr string) (net.Listener, error) {
+	return tls.Listen("tcp", addr, t.config)
+}
+
+// memTransport is an in-process transport backed by net.Pipe, for tests
+// that want a full Caller<->Caller connection without real sockets. Listen
+// registers a name; Dial connects to whichever listener is registered
+// under that name.
+type memTransport struct {
+	mu        sync.Mutex
+	listeners map[string]*memListener
+}
+
+func newMemTransport() *memTransport {
+	return &memTransport{listeners: make(map[string]*memListener)}
+}
+
+func (t *memTransport) Listen(name string) (net.Listener, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, exists := t.listeners[name]; exists {
+		return nil, fmt.Errorf("blab: mem transport %q already listening", name)
+	}
+	l := &memListener{name: name, transport: t, conns: make(chan net.Conn), closed: make(chan struct{})}
+	t.listeners[name] = l
+	return l, nil
+}
+
+func (t *memTransport) Dial(name string) (net.Conn, error) {
+	t.mu.Lock()
+	l, ok := t.listeners[name]
+	t.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("blab: mem transport %q: connection refused", name)
+	}
+
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, fmt.Errorf("blab: mem transport %q: connection refused", name)
+	}
+}
+
+// memListener is the net.Listener returned by memTransport.Listen.
+type memListener struct {
+	name      string
+	transport *memTransport
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, ErrClosed
+	}
+}
+
+func (l *memListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.transport.mu.Lock()
+		delete(l.transport.listeners, l.name)
+		l.transport.mu.Unlock()
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr { return memAddr(l.name) }
+
+// memAddr implements net.Addr for the mem transport.
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }